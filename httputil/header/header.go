@@ -0,0 +1,97 @@
+// Package header implements RFC 7231 content negotiation helpers for
+// parsing Accept headers and matching them against a Content-Type.
+package header
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptSpec is a single media-range entry from an Accept header, such as
+// "text/html;q=0.9".
+type AcceptSpec struct {
+	Value string
+	Q     float64
+}
+
+// ParseAccept parses the Accept header in h into a list of AcceptSpec
+// sorted by descending q-value. A missing q parameter defaults to 1.0; a
+// malformed one is treated as 0 (i.e. not acceptable).
+func ParseAccept(h http.Header) []AcceptSpec {
+	raw := h.Get("Accept")
+	if raw == "" {
+		return nil
+	}
+
+	parts := strings.Split(raw, ",")
+	specs := make([]AcceptSpec, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		segments := strings.Split(part, ";")
+		spec := AcceptSpec{Value: strings.TrimSpace(segments[0]), Q: 1.0}
+		for _, param := range segments[1:] {
+			key, value, found := strings.Cut(param, "=")
+			if !found {
+				continue
+			}
+			key = strings.TrimSpace(key)
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if strings.EqualFold(key, "q") {
+				q, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+				spec.Q = q
+			}
+		}
+		specs = append(specs, spec)
+	}
+
+	sort.SliceStable(specs, func(i, j int) bool { return specs[i].Q > specs[j].Q })
+	return specs
+}
+
+// Negotiate returns the first offer that matches an acceptable media range
+// in accept, trying ranges in the order given (ParseAccept returns them by
+// descending q) and skipping any with q <= 0. It returns "" if nothing
+// matches.
+func Negotiate(offers []string, accept []AcceptSpec) string {
+	for _, spec := range accept {
+		if spec.Q <= 0 {
+			continue
+		}
+		for _, offer := range offers {
+			if mediaRangeMatches(offer, spec.Value) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+// mediaRangeMatches reports whether mediaType satisfies the media-range
+// pattern, honoring "*/*" and "type/*" wildcards.
+func mediaRangeMatches(mediaType, pattern string) bool {
+	if pattern == "*/*" {
+		return true
+	}
+
+	typeParts := strings.SplitN(mediaType, "/", 2)
+	patternParts := strings.SplitN(pattern, "/", 2)
+	if len(typeParts) != 2 || len(patternParts) != 2 {
+		return false
+	}
+	if patternParts[0] != "*" && patternParts[0] != typeParts[0] {
+		return false
+	}
+	if patternParts[1] != "*" && patternParts[1] != typeParts[1] {
+		return false
+	}
+	return true
+}
@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/developanunderstanding/curl/httputil/header"
 	"github.com/jessevdk/go-flags"
 	"github.com/juju/ratelimit"
 	"github.com/pkg/errors"
@@ -35,6 +45,30 @@ type Arguments struct {
 	URL              string
 	MaxDownload      *string `long:"max-filesize" description:"Maximum filesize to download" value-name:"BYTES"`
 	MaxDownloadBytes int64
+	ContinueAt       *string `short:"C" long:"continue-at" description:"Resume a transfer, OFFSET or '-' to auto-detect from the output file" value-name:"OFFSET"`
+	ContinueAtBytes  int64
+	Retry            int  `long:"retry" description:"Retry a transient transfer failure N times"`
+	RetryDelay       int  `long:"retry-delay" description:"Seconds to wait between retries" value-name:"SECONDS"`
+	Location         bool `short:"L" long:"location" description:"Follow redirects"`
+	MaxRedirs        *int `long:"max-redirs" description:"Maximum number of redirects to follow (default 50)" value-name:"N"`
+	MaxRedirsValue   int
+	Post301          bool     `long:"post301" description:"Do not switch to GET after a 301 redirect on a POST request"`
+	Post302          bool     `long:"post302" description:"Do not switch to GET after a 302 redirect on a POST request"`
+	Post303          bool     `long:"post303" description:"Do not switch to GET after a 303 redirect on a POST request"`
+	Accept           *string  `short:"A" long:"accept" description:"Offered media ranges, e.g. \"text/html;q=1.0, application/json;q=0.5\"" value-name:"TYPES"`
+	AcceptAny        bool     `long:"accept-any" description:"Don't fail when the response Content-Type doesn't match --accept"`
+	Form             []string `short:"F" long:"form" description:"Add multipart form field: name=value or name=@path[;type=...;filename=...]" value-name:"CONTENT"`
+	FormFields       []formField
+	ConnectTimeout   *int `long:"connect-timeout" description:"Max seconds allowed for connection" value-name:"SECS"`
+	MaxTime          *int `long:"max-time" description:"Max seconds allowed for the whole operation" value-name:"SECS"`
+	Compressed       bool `long:"compressed" description:"Request a compressed response and decompress it transparently"`
+	HTTP1            bool `long:"http1.1" description:"Use HTTP/1.1"`
+	HTTP2            bool `long:"http2" description:"Use HTTP/2"`
+	Insecure         bool `short:"k" long:"insecure" description:"Allow insecure connections when using TLS"`
+	Transport        *http.Transport
+	CookieInput      *string `short:"b" long:"cookie" description:"Read cookies from DATA (\"name=value; name2=value2\") or a Netscape cookie-jar FILE" value-name:"DATA|FILE"`
+	CookieJarFile    *string `long:"cookie-jar" short:"c" description:"Write cookies to FILE in Netscape format after the request" value-name:"FILE"`
+	Cookies          *cookieJar
 	Verbose          []bool `short:"v" long:"verbose"`
 }
 
@@ -92,6 +126,7 @@ func parseFlags() {
 	// Check if certain headers are specified by user
 	isContentTypeSpecified := false
 	isContentLengthSpecified := false
+	isAcceptSpecified := false
 	for key := range args.Headers {
 		switch strings.ToUpper(key) {
 		case "CONTENT-TYPE":
@@ -100,6 +135,9 @@ func parseFlags() {
 		case "CONTENT-LENGTH":
 			isContentLengthSpecified = true
 			break
+		case "ACCEPT":
+			isAcceptSpecified = true
+			break
 		}
 	}
 
@@ -115,6 +153,9 @@ func parseFlags() {
 	if args.Data != nil && !isContentLengthSpecified {
 		args.Headers["Content-Length"] = strconv.Itoa(len(*args.Data))
 	}
+	if args.Accept != nil && !isAcceptSpecified {
+		args.Headers["Accept"] = *args.Accept
+	}
 
 	if args.LimitRate != nil {
 		args.LimitRateBytes, err = parseSize(*args.LimitRate)
@@ -129,30 +170,110 @@ func parseFlags() {
 			panic(err)
 		}
 	}
+
+	if args.ContinueAt != nil {
+		if *args.ContinueAt == "-" {
+			// auto-detect offset from the size of the existing output file
+			if args.OutputFile != nil {
+				if info, statErr := os.Stat(*args.OutputFile); statErr == nil {
+					args.ContinueAtBytes = info.Size()
+				}
+			}
+		} else {
+			args.ContinueAtBytes, err = strconv.ParseInt(*args.ContinueAt, 10, 64)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	args.MaxRedirsValue = 50
+	if args.MaxRedirs != nil {
+		args.MaxRedirsValue = *args.MaxRedirs
+	}
+
+	if len(args.Form) > 0 {
+		args.FormFields = make([]formField, 0, len(args.Form))
+		for _, raw := range args.Form {
+			field, ferr := parseFormField(raw)
+			if ferr != nil {
+				panic(ferr)
+			}
+			args.FormFields = append(args.FormFields, field)
+		}
+	}
+
+	if args.HTTP1 && args.HTTP2 {
+		panic(errors.New("--http1.1 and --http2 are mutually exclusive"))
+	}
+
+	args.Transport = newTransport()
+
+	if args.CookieInput != nil || args.CookieJarFile != nil {
+		args.Cookies = newCookieJar()
+	}
+	if args.CookieInput != nil {
+		cookies, cerr := loadCookieInput(*args.CookieInput)
+		if cerr != nil {
+			panic(cerr)
+		}
+		args.Cookies.seed(cookies)
+	}
+}
+
+// newTransport builds the *http.Transport used for every request, wiring
+// up connection pooling, --connect-timeout, --compressed and the
+// --http1.1/--http2/-k toggles. --http2 puts "h2" in the TLS ALPN offer,
+// but net/http still adds "http/1.1" to it, so a server without HTTP/2
+// completes the handshake over HTTP/1.1; send rejects any response whose
+// negotiated protocol isn't "h2".
+func newTransport() *http.Transport {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  !args.Compressed,
+		ForceAttemptHTTP2:   !args.HTTP1,
+	}
+
+	dialer := &net.Dialer{}
+	if args.ConnectTimeout != nil {
+		dialer.Timeout = time.Duration(*args.ConnectTimeout) * time.Second
+	}
+	transport.DialContext = dialer.DialContext
+
+	if args.Insecure || args.HTTP2 {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: args.Insecure}
+	}
+
+	if args.HTTP1 {
+		// a non-nil, empty map disables HTTP/2 entirely, per the net/http docs
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else if args.HTTP2 {
+		// offer h2 over ALPN; net/http appends http/1.1 to this list, so
+		// send() is what fails a connection that didn't negotiate h2.
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+
+	return transport
 }
 
 func main() {
 	parseFlags()
 
-	// construct request
-	var req *http.Request
-	var err error
-	if args.Data != nil {
-		// if there's a body...
-		body := bytes.NewBufferString(*args.Data)
-		if args.LimitRate != nil {
-			// ... and we're rate limiting
-			bucket := ratelimit.NewBucketWithRate(float64(args.LimitRateBytes), args.LimitRateBytes)
-			limiter := ratelimit.Reader(body, bucket)
-			req, err = http.NewRequest(args.HTTPMethod, args.URL, limiter)
-		} else {
-			// ... and we're NOT rate limiting
-			req, err = http.NewRequest(args.HTTPMethod, args.URL, body)
-		}
-	} else {
-		// if there's no body
-		req, err = http.NewRequest(args.HTTPMethod, args.URL, nil)
+	if args.CookieJarFile != nil {
+		// persist whatever cookies were seen even if the request ultimately
+		// fails or gets a non-2xx response, so login flows can be debugged
+		defer func() {
+			data := serializeNetscapeCookies(args.Cookies.list())
+			if err := ioutil.WriteFile(*args.CookieJarFile, []byte(data), 0666); err != nil {
+				panic(err)
+			}
+		}()
 	}
+
+	// construct request
+	body, multipartContentType := rebuildBody()
+	req, err := http.NewRequest(args.HTTPMethod, args.URL, body)
 	if err != nil {
 		panic(err)
 	}
@@ -161,49 +282,82 @@ func main() {
 	for key, value := range args.Headers {
 		req.Header.Add(key, strings.TrimSpace(value))
 	}
+	if multipartContentType != "" {
+		// -F streams a multipart body; its boundary overrides any guessed
+		// Content-Type and its length is unknown up front (chunked).
+		req.Header.Set("Content-Type", multipartContentType)
+		req.Header.Del("Content-Length")
+	}
 
-	// print request info if verbose is set
-	if len(args.Verbose) >= 1 {
-		fmt.Printf("%s %s %s\n", req.Proto, req.Method, req.URL)
-		for key, values := range req.Header {
-			for _, value := range values {
-				fmt.Printf("%s: %s\n", key, value)
+	// resume a previous transfer from the detected/requested offset
+	if args.ContinueAtBytes > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", args.ContinueAtBytes))
+	}
+
+	// --max-time bounds the whole operation, including any preflight,
+	// redirects and retries, since they all share req's context.
+	if args.MaxTime != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*args.MaxTime)*time.Second)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	// HEAD preflight: resolve the output filename and enforce --max-filesize
+	// before opening a socket for a potentially oversized body.
+	if args.MaxDownload != nil || args.UseRemoteName {
+		if preflightRes, ok := preflightHead(req); ok {
+			if args.MaxDownload != nil && preflightRes.ContentLength >= 0 && preflightRes.ContentLength > args.MaxDownloadBytes {
+				preflightRes.Body.Close()
+				panic(errors.Errorf("remote file size %d exceeds --max-filesize %d", preflightRes.ContentLength, args.MaxDownloadBytes))
 			}
-		}
-		if args.OutputFile == nil && args.OutputStream == nil {
-			// print extra line between headers and response
-			fmt.Println()
+			if args.UseRemoteName {
+				args.OutputFile = new(string)
+				*args.OutputFile = resolveFilename(preflightRes)
+			}
+			preflightRes.Body.Close()
 		}
 	}
 
-	// make the request
-	res, err := http.DefaultClient.Do(req)
+	// make the request, following redirects if -L was given
+	res, err := followRedirects(req)
 	if err != nil {
 		panic(err)
 	}
-	defer res.Body.Close()
+	defer func() { res.Body.Close() }()
+	req = res.Request
+
+	if args.ContinueAtBytes > 0 && res.StatusCode != http.StatusPartialContent {
+		panic(errors.Errorf("server did not honor Range request, expected 206 Partial Content but got %d", res.StatusCode))
+	}
+
+	if args.Accept != nil {
+		contentType, _, _ := strings.Cut(res.Header.Get("Content-Type"), ";")
+		contentType = strings.TrimSpace(contentType)
+		negotiated := header.Negotiate([]string{contentType}, header.ParseAccept(req.Header))
+		if negotiated == "" && !args.AcceptAny {
+			panic(errors.Errorf("response Content-Type %q does not match --accept %q", contentType, *args.Accept))
+		}
+		if len(args.Verbose) >= 1 {
+			fmt.Printf("* negotiated content type: %s\n", negotiated)
+		}
+	}
 
 	// prepare output stream for file or stdout
 	if args.OutputFile == nil {
 		if args.UseRemoteName {
-			disposition := res.Header.Get("Content-Disposition")
-			if disposition != "" {
-				pattern := regexp.MustCompile(`filename="?(.+)"?`)
-				matches := pattern.FindStringSubmatch(disposition)
-				if len(matches) >= 2 {
-					args.OutputFile = new(string)
-					*args.OutputFile = matches[1]
-				}
-			} else {
-				args.OutputFile = new(string)
-				*args.OutputFile = path.Base(args.URL)
-			}
+			args.OutputFile = new(string)
+			*args.OutputFile = resolveFilename(res)
 		} else {
 			args.OutputStream = os.Stdout
 		}
 	}
 	if args.OutputFile != nil {
-		args.OutputStream, err = os.OpenFile(*args.OutputFile, os.O_CREATE|os.O_WRONLY, 0666)
+		openFlags := os.O_CREATE | os.O_WRONLY
+		if args.ContinueAtBytes > 0 {
+			// append to the existing file instead of truncating it
+			openFlags |= os.O_APPEND
+		}
+		args.OutputStream, err = os.OpenFile(*args.OutputFile, openFlags, 0666)
 		if err != nil {
 			panic(err)
 		}
@@ -213,10 +367,28 @@ func main() {
 	// read response, write to output
 	buffer := make([]byte, 1024)
 	var n int
-	var total int64
+	total := args.ContinueAtBytes
+	retries := 0
 	for {
 		n, err = res.Body.Read(buffer)
 		if err != nil && err != io.EOF {
+			// connection dropped mid-body; reconnect from where we left off
+			if retries < args.Retry {
+				retries++
+				res.Body.Close()
+				if args.RetryDelay > 0 {
+					time.Sleep(time.Duration(args.RetryDelay) * time.Second)
+				}
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", total))
+				res, err = send(req)
+				if err != nil {
+					panic(err)
+				}
+				if res.StatusCode != http.StatusPartialContent {
+					panic(errors.Errorf("server did not honor Range request on retry, expected 206 Partial Content but got %d", res.StatusCode))
+				}
+				continue
+			}
 			panic(err)
 		}
 		if args.MaxDownload != nil && total+int64(n) >= args.MaxDownloadBytes {
@@ -237,6 +409,533 @@ func main() {
 	// All done!
 }
 
+// resolveFilename derives an output filename from a response's
+// Content-Disposition header, falling back to the last path element of
+// the URL given on the command line (not the URL after any redirects).
+func resolveFilename(res *http.Response) string {
+	if disposition := res.Header.Get("Content-Disposition"); disposition != "" {
+		pattern := regexp.MustCompile(`filename="?(.+)"?`)
+		if matches := pattern.FindStringSubmatch(disposition); len(matches) >= 2 {
+			return matches[1]
+		}
+	}
+	return path.Base(args.URL)
+}
+
+// preflightHead issues a HEAD request that mirrors req's URL, headers and
+// redirect handling, so --max-filesize and -O can be resolved before the
+// GET opens a socket for the body. It reports false when the server
+// doesn't support HEAD (405), in which case callers fall back to the
+// existing streaming byte cap.
+func preflightHead(req *http.Request) (*http.Response, bool) {
+	headReq, err := http.NewRequest(http.MethodHead, req.URL.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	headReq = headReq.WithContext(req.Context())
+	headReq.Header = req.Header.Clone()
+	headReq.Header.Del("Content-Length")
+	headReq.Header.Del("Content-Type")
+	headReq.Header.Del("Range")
+
+	res, err := followRedirects(headReq)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode == http.StatusMethodNotAllowed {
+		res.Body.Close()
+		return nil, false
+	}
+	return res, true
+}
+
+// makeBody builds a fresh reader for the request body (wrapped in the rate
+// limiter again if one was requested), so it can be rebuilt for each
+// redirect hop rather than reused once the first attempt has consumed it.
+func makeBody() io.Reader {
+	if args.Data == nil {
+		return nil
+	}
+	body := bytes.NewBufferString(*args.Data)
+	if args.LimitRate == nil {
+		return body
+	}
+	bucket := ratelimit.NewBucketWithRate(float64(args.LimitRateBytes), args.LimitRateBytes)
+	return ratelimit.Reader(body, bucket)
+}
+
+// rebuildBody returns a fresh request body reader plus a Content-Type to
+// apply, rebuilding it from scratch each time it's called so it can be
+// replayed across redirect hops. The Content-Type is only non-empty for a
+// -F multipart body, whose boundary is chosen per writer instance.
+func rebuildBody() (io.Reader, string) {
+	if len(args.FormFields) > 0 {
+		return buildMultipartBody()
+	}
+	return makeBody(), ""
+}
+
+// buildMultipartBody streams args.FormFields as a multipart/form-data body
+// through an io.Pipe so large file uploads never buffer in memory. File
+// parts are opened lazily, on the writer goroutine, as they're reached.
+func buildMultipartBody() (io.Reader, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		var err error
+		for _, field := range args.FormFields {
+			if field.isFile {
+				err = writeFormFile(mw, field)
+			} else {
+				err = mw.WriteField(field.name, field.value)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var body io.Reader = pr
+	if args.LimitRate != nil {
+		bucket := ratelimit.NewBucketWithRate(float64(args.LimitRateBytes), args.LimitRateBytes)
+		body = ratelimit.Reader(pr, bucket)
+	}
+	return body, mw.FormDataContentType()
+}
+
+// writeFormFile opens field.filepath and streams it into mw as a file
+// part, sniffing its Content-Type from the first 512 bytes when the user
+// didn't specify one with ";type=...".
+func writeFormFile(mw *multipart.Writer, field formField) error {
+	file, err := os.Open(field.filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	mimeType := field.mimeType
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sniff = sniff[:n]
+	if mimeType == "" {
+		mimeType = http.DetectContentType(sniff)
+	}
+
+	partHeader := make(textproto.MIMEHeader)
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field.name, field.filename))
+	partHeader.Set("Content-Type", mimeType)
+	part, err := mw.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(sniff); err != nil {
+		return err
+	}
+	_, err = io.Copy(part, file)
+	return err
+}
+
+// formField is a single parsed -F entry: either a plain value or an
+// upload sourced from a file on disk.
+type formField struct {
+	name     string
+	value    string
+	isFile   bool
+	filepath string
+	filename string
+	mimeType string
+}
+
+// parseFormField parses a single -F argument, either "name=value" or
+// "name=@path[;type=...;filename=...]".
+func parseFormField(raw string) (formField, error) {
+	name, rest, found := strings.Cut(raw, "=")
+	if !found {
+		return formField{}, errors.Errorf("invalid -F entry %q, expected name=value", raw)
+	}
+
+	if !strings.HasPrefix(rest, "@") {
+		return formField{name: name, value: rest}, nil
+	}
+
+	segments := strings.Split(rest[1:], ";")
+	field := formField{name: name, isFile: true, filepath: segments[0], filename: path.Base(segments[0])}
+	for _, param := range segments[1:] {
+		key, value, found := strings.Cut(param, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "type":
+			field.mimeType = value
+		case "filename":
+			field.filename = value
+		}
+	}
+	return field, nil
+}
+
+// tlsVersionName renders a tls.VersionTLS* constant the way curl -v does.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "unknown"
+}
+
+// isRedirectStatus reports whether code is an HTTP redirect status.
+func isRedirectStatus(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// traceHop prints a single request/response hop in curl's -v style.
+func traceHop(req *http.Request, res *http.Response) {
+	fmt.Printf("> %s %s %s\n", req.Method, req.URL, req.Proto)
+	for key, values := range req.Header {
+		for _, value := range values {
+			fmt.Printf("> %s: %s\n", key, value)
+		}
+	}
+	fmt.Println(">")
+	if res.TLS != nil {
+		fmt.Printf("* ALPN: %s, TLS version: %s\n", res.TLS.NegotiatedProtocol, tlsVersionName(res.TLS.Version))
+	}
+	fmt.Printf("< %s %s\n", res.Proto, res.Status)
+	for key, values := range res.Header {
+		for _, value := range values {
+			fmt.Printf("< %s: %s\n", key, value)
+		}
+	}
+	fmt.Println("<")
+}
+
+// followRedirects sends req and, when -L/--location is set, follows any
+// redirect responses up to --max-redirs hops, rebuilding the request body
+// for each new hop. --post301/--post302/--post303 control whether a POST's
+// method and body survive the corresponding redirect status instead of
+// being downgraded to a bodyless GET. The returned response's Request field
+// holds the request that actually produced it.
+func followRedirects(req *http.Request) (*http.Response, error) {
+	hops := 0
+	for {
+		res, err := send(req)
+		if err != nil {
+			return nil, err
+		}
+		res.Request = req
+
+		if len(args.Verbose) >= 1 {
+			traceHop(req, res)
+		}
+
+		if !args.Location || !isRedirectStatus(res.StatusCode) {
+			return res, nil
+		}
+
+		location := res.Header.Get("Location")
+		if location == "" {
+			return res, nil
+		}
+		redirectURL, err := req.URL.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+
+		hops++
+		if hops > args.MaxRedirsValue {
+			return nil, errors.Errorf("maximum redirects (%d) exceeded", args.MaxRedirsValue)
+		}
+		res.Body.Close()
+
+		method := req.Method
+		var body io.Reader
+		var contentType string
+		switch res.StatusCode {
+		case http.StatusMovedPermanently:
+			if method == http.MethodPost && !args.Post301 {
+				method = http.MethodGet
+			} else {
+				body, contentType = rebuildBody()
+			}
+		case http.StatusFound:
+			if method == http.MethodPost && !args.Post302 {
+				method = http.MethodGet
+			} else {
+				body, contentType = rebuildBody()
+			}
+		case http.StatusSeeOther:
+			if args.Post303 && method == http.MethodPost {
+				body, contentType = rebuildBody()
+			} else if method != http.MethodHead {
+				method = http.MethodGet
+			}
+		default: // 307, 308: method and body always survive
+			body, contentType = rebuildBody()
+		}
+
+		nextReq, err := http.NewRequest(method, redirectURL.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		nextReq = nextReq.WithContext(req.Context())
+		nextReq.Header = req.Header.Clone()
+		if body == nil {
+			nextReq.Header.Del("Content-Length")
+			nextReq.Header.Del("Content-Type")
+		} else if contentType != "" {
+			nextReq.Header.Set("Content-Type", contentType)
+			nextReq.Header.Del("Content-Length")
+		}
+		req = nextReq
+	}
+}
+
+// cookieJar tracks cookies across the HEAD preflight, redirect hops and
+// retries of a single invocation. It wraps a cookiejar.Jar for the
+// domain/path matching rules used when attaching cookies to outgoing
+// requests, plus a map of the latest cookie seen for each (domain, path,
+// name) so that -c/--cookie-jar can persist full attributes (Domain,
+// Path, Secure, Expires) that cookiejar.Jar.Cookies does not expose,
+// without writing out every stale value a cookie has ever held.
+type cookieJar struct {
+	jar *cookiejar.Jar
+	all map[string]*http.Cookie
+}
+
+// newCookieJar builds an empty cookieJar backed by the standard library's
+// public-suffix-naive jar implementation.
+func newCookieJar() *cookieJar {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &cookieJar{jar: jar, all: make(map[string]*http.Cookie)}
+}
+
+// cookieKey identifies a cookie by the fields a Netscape jar keys on, so
+// a later Set-Cookie for the same (domain, path, name) replaces rather
+// than duplicates the one store holds.
+func cookieKey(cookie *http.Cookie) string {
+	return cookie.Domain + "\x00" + cookie.Path + "\x00" + cookie.Name
+}
+
+// store records cookies as having come from host, filling in Domain when
+// the server didn't set one (the common case for host-only session
+// cookies) so -c/--cookie-jar always writes a non-empty Domain field.
+func (c *cookieJar) store(host string, cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		if cookie.Domain == "" {
+			cookie.Domain = host
+		}
+		c.all[cookieKey(cookie)] = cookie
+	}
+}
+
+// list returns the latest cookie for every (domain, path, name) seen so
+// far, sorted for stable -c/--cookie-jar output.
+func (c *cookieJar) list() []*http.Cookie {
+	cookies := make([]*http.Cookie, 0, len(c.all))
+	for _, cookie := range c.all {
+		cookies = append(cookies, cookie)
+	}
+	sort.Slice(cookies, func(i, j int) bool { return cookieKey(cookies[i]) < cookieKey(cookies[j]) })
+	return cookies
+}
+
+// seed loads cookies supplied via -b/--cookie into the jar before the
+// first request is sent, so they're attached the same way a cookie
+// received from the server would be.
+func (c *cookieJar) seed(cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		// each cookie is set against its own domain, since the jar drops
+		// cookies whose Domain doesn't match the URL they're set for
+		u := &url.URL{Scheme: "http", Host: strings.TrimPrefix(cookie.Domain, ".")}
+		if u.Host == "" {
+			// inline "name=value" cookies carry no domain; attach them to
+			// whatever host the request targets instead.
+			if parsed, err := url.Parse(args.URL); err == nil {
+				u.Host = parsed.Host
+			}
+		}
+		c.jar.SetCookies(u, []*http.Cookie{cookie})
+		c.store(u.Host, []*http.Cookie{cookie})
+	}
+}
+
+// attach sets req's Cookie header to the cookies the jar has for req.URL,
+// replacing any Cookie header already present. Without this, a header
+// cloned forward from a previous hop (redirects) or reused across a
+// retry would accumulate an extra copy of the same cookies every time.
+func (c *cookieJar) attach(req *http.Request) {
+	req.Header.Del("Cookie")
+	for _, cookie := range c.jar.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+}
+
+// record stores any Set-Cookie cookies from res against req.URL, both in
+// the jar (for subsequent requests) and keyed by identity (for
+// -c/--cookie-jar persistence), so a later hop that resets the same
+// cookie replaces its earlier value instead of appending to it.
+func (c *cookieJar) record(req *http.Request, res *http.Response) {
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	c.jar.SetCookies(req.URL, cookies)
+	c.store(req.URL.Hostname(), cookies)
+}
+
+// send performs a single RoundTrip through args.Transport, attaching any
+// cookies the jar holds for req.URL beforehand and recording any the
+// response sets afterward. Every direct call to args.Transport.RoundTrip
+// in this file goes through send instead, so the cookie jar (when -b or
+// -c is in effect) sees every hop: HEAD preflight, redirects and retries.
+func send(req *http.Request) (*http.Response, error) {
+	if args.Cookies != nil {
+		args.Cookies.attach(req)
+	}
+	res, err := args.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if args.HTTP2 && (res.TLS == nil || res.TLS.NegotiatedProtocol != "h2") {
+		res.Body.Close()
+		return nil, errors.Errorf("--http2 requested but %s did not negotiate HTTP/2", req.URL.Host)
+	}
+	if args.Cookies != nil {
+		args.Cookies.record(req, res)
+	}
+	return res, nil
+}
+
+// loadCookieInput resolves the DATA|FILE argument to -b/--cookie: if it
+// names an existing file, the file is parsed as a Netscape cookie jar;
+// otherwise the value itself is parsed as an inline "name=value;
+// name2=value2" cookie string.
+func loadCookieInput(value string) ([]*http.Cookie, error) {
+	if data, err := ioutil.ReadFile(value); err == nil {
+		return parseNetscapeCookies(string(data))
+	}
+	return parseInlineCookies(value), nil
+}
+
+// parseInlineCookies parses a "name=value; name2=value2" string as given
+// directly on the command line.
+func parseInlineCookies(value string) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val, found := strings.Cut(part, "=")
+		if !found {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: strings.TrimSpace(name), Value: val})
+	}
+	return cookies
+}
+
+// parseNetscapeCookies parses the tab-delimited Netscape cookie-jar
+// format used by curl's -b/-c flags: domain, includeSubdomains, path,
+// secure, expires, name, value. Lines beginning with "#" are comments,
+// except for the "#HttpOnly_" prefix, which marks an HttpOnly cookie and
+// is stripped before the rest of the line is parsed as usual.
+func parseNetscapeCookies(data string) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	for _, line := range strings.Split(data, "\n") {
+		// trim only the line ending, not all whitespace: a host-only
+		// cookie's Domain field is legitimately empty, leaving a leading
+		// tab that TrimSpace would otherwise eat, corrupting the split.
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			httpOnly = true
+			line = rest
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, errors.Errorf("malformed Netscape cookie line: %q", line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed expiry in cookie line: %q", line)
+		}
+		cookie := &http.Cookie{
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expires != 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies, nil
+}
+
+// serializeNetscapeCookies renders cookies back into the Netscape
+// cookie-jar format written by -c/--cookie-jar.
+func serializeNetscapeCookies(cookies []*http.Cookie) string {
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n")
+	for _, cookie := range cookies {
+		includeSubdomains := "FALSE"
+		if strings.HasPrefix(cookie.Domain, ".") {
+			includeSubdomains = "TRUE"
+		}
+		path := cookie.Path
+		if path == "" {
+			path = "/"
+		}
+		secure := "FALSE"
+		if cookie.Secure {
+			secure = "TRUE"
+		}
+		var expires int64
+		if !cookie.Expires.IsZero() {
+			expires = cookie.Expires.Unix()
+		}
+		domain := cookie.Domain
+		if cookie.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, includeSubdomains, path, secure, expires, cookie.Name, cookie.Value)
+	}
+	return b.String()
+}
+
 // guessDataType checks for json or form data
 func guessDataType(data string) (contentType string, requiresHeader bool) {
 	temp := json.RawMessage{}